@@ -46,11 +46,6 @@ func generateLargeFile() {
 func sortLargeFile() {
 	fmt.Println("Sort engine initialization ...")
 
-	chunkFunc := func(r io.Reader) ([]byte, error) {
-		reader := bufio.NewReader(r)
-		return reader.ReadBytes(byte(linesDelim))
-	}
-
 	lessFunc := func(b1 []byte, b2 []byte) bool {
 		return bytes.Compare(b1, b2) < 0
 	}
@@ -61,7 +56,7 @@ func sortLargeFile() {
 	}
 	defer sortedFile.Close()
 
-	engine, createEngineErr := extsort.New(sortedFile, chunkFunc, lessFunc, memLimit)
+	engine, createEngineErr := extsort.New(sortedFile, lessFunc, memLimit)
 	if createEngineErr != nil {
 		panic(fmt.Errorf("cannot create sort engine: %s", createEngineErr))
 	}
@@ -83,7 +78,9 @@ func sortLargeFile() {
 	reader := bufio.NewReader(inputFile)
 	for {
 		line, readErr := reader.ReadBytes(byte(linesDelim))
-		_, writeErr := engine.Write(line)
+		// The whole line is used as the key and the value is left empty,
+		// since this generator only needs whole-record sorting.
+		writeErr := engine.Collect(line, nil)
 		if writeErr != nil {
 			panic(fmt.Errorf("cannot write to %s: %s", outputFileName, writeErr))
 		}
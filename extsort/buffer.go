@@ -0,0 +1,264 @@
+package extsort
+
+import (
+	"io"
+	"sort"
+)
+
+// entrySliceHeaderOverhead approximates the memory cost of the two slice
+// headers (key and value) that back every entry, so that memory accounting
+// reflects more than just the raw payload bytes.
+const entrySliceHeaderOverhead = 2 * 24
+
+// Buffer accumulates key/value pairs in memory before they are sorted and
+// flushed to a temp file. Implementations differ in how they treat duplicate
+// keys, which lets callers pick the merge semantics that fit their data
+// (unique keys, value accumulation, or first-write-wins) instead of forcing
+// everything through a single opaque byte blob.
+//
+// That duplicate-key handling only ever sees the keys Put into one buffer:
+// once a buffer is full it is sorted and spilled independently of every
+// other buffer, and the k-way merge that later combines spill files has no
+// notion of "same key, different buffer" and emits each spilled entry as-is.
+// So NewAppendSortableBuffer's concatenation and NewOldestAppearsFirstBuffer's
+// first-wins behavior only hold within a single SizeLimit-sized buffer, not
+// across a whole sort with more input than fits in one buffer; callers who
+// need a global guarantee must post-process the merged output themselves.
+//
+// Modeled on the buffer abstraction used by erigon's etl package.
+type Buffer interface {
+	// Put adds a key/value pair to the buffer.
+	Put(k, v []byte)
+
+	// Get returns the key and value stored at index i, appending them to the
+	// given reusable buffers.
+	Get(i int, keyBuf, valBuf []byte) ([]byte, []byte)
+
+	// Len returns the number of entries currently stored in the buffer.
+	Len() int
+
+	// Sort sorts the buffer entries by key using the buffer's Less function.
+	Sort()
+
+	// Reset discards all entries but keeps the underlying storage for reuse.
+	Reset()
+
+	// SizeLimit returns the configured size limit in bytes.
+	SizeLimit() int
+
+	// CheckFlushSize reports whether the buffer has grown past SizeLimit and
+	// should be sorted and flushed to a temp file.
+	CheckFlushSize() bool
+}
+
+// BufferFactory creates a new Buffer with the given size limit in bytes.
+type BufferFactory func(sizeLimit int) Buffer
+
+type entry struct {
+	key []byte
+	val []byte
+}
+
+func (e entry) size() int {
+	return len(e.key) + len(e.val) + entrySliceHeaderOverhead
+}
+
+// sortableBuffer is a Buffer for data sets where keys are already unique.
+// It stores entries as-is and sorts them without attempting to merge
+// duplicates.
+type sortableBuffer struct {
+	entries   []entry
+	size      int
+	sizeLimit int
+	lessFunc  Less
+}
+
+// NewSortableBuffer returns a BufferFactory producing buffers that keep one
+// entry per Put call, sorted by lessFunc. Use it when keys are already
+// guaranteed to be unique.
+func NewSortableBuffer(lessFunc Less) BufferFactory {
+	return func(sizeLimit int) Buffer {
+		return &sortableBuffer{sizeLimit: sizeLimit, lessFunc: lessFunc}
+	}
+}
+
+func (b *sortableBuffer) Put(k, v []byte) {
+	e := entry{key: append([]byte(nil), k...), val: append([]byte(nil), v...)}
+	b.entries = append(b.entries, e)
+	b.size += e.size()
+}
+
+func (b *sortableBuffer) Get(i int, keyBuf, valBuf []byte) ([]byte, []byte) {
+	e := b.entries[i]
+	return append(keyBuf[:0], e.key...), append(valBuf[:0], e.val...)
+}
+
+func (b *sortableBuffer) Len() int {
+	return len(b.entries)
+}
+
+func (b *sortableBuffer) Sort() {
+	sort.Slice(b.entries, func(i, j int) bool {
+		return b.lessFunc(b.entries[i].key, b.entries[j].key)
+	})
+}
+
+func (b *sortableBuffer) Reset() {
+	b.entries = b.entries[:0]
+	b.size = 0
+}
+
+func (b *sortableBuffer) SizeLimit() int {
+	return b.sizeLimit
+}
+
+func (b *sortableBuffer) CheckFlushSize() bool {
+	return b.size >= b.sizeLimit
+}
+
+// appendSortableBuffer is a Buffer for data sets with duplicate keys where
+// values belonging to the same key should be accumulated by concatenating
+// them in Put order.
+type appendSortableBuffer struct {
+	entries   []entry
+	index     map[string]int
+	size      int
+	sizeLimit int
+	lessFunc  Less
+}
+
+// NewAppendSortableBuffer returns a BufferFactory producing buffers that
+// concatenate values Put under the same key, in the order they were added.
+func NewAppendSortableBuffer(lessFunc Less) BufferFactory {
+	return func(sizeLimit int) Buffer {
+		return &appendSortableBuffer{
+			sizeLimit: sizeLimit,
+			lessFunc:  lessFunc,
+			index:     make(map[string]int),
+		}
+	}
+}
+
+func (b *appendSortableBuffer) Put(k, v []byte) {
+	if i, ok := b.index[string(k)]; ok {
+		old := b.entries[i]
+		b.size -= old.size()
+		b.entries[i].val = append(b.entries[i].val, v...)
+		b.size += b.entries[i].size()
+		return
+	}
+
+	e := entry{key: append([]byte(nil), k...), val: append([]byte(nil), v...)}
+	b.index[string(e.key)] = len(b.entries)
+	b.entries = append(b.entries, e)
+	b.size += e.size()
+}
+
+func (b *appendSortableBuffer) Get(i int, keyBuf, valBuf []byte) ([]byte, []byte) {
+	e := b.entries[i]
+	return append(keyBuf[:0], e.key...), append(valBuf[:0], e.val...)
+}
+
+func (b *appendSortableBuffer) Len() int {
+	return len(b.entries)
+}
+
+func (b *appendSortableBuffer) Sort() {
+	sort.Slice(b.entries, func(i, j int) bool {
+		return b.lessFunc(b.entries[i].key, b.entries[j].key)
+	})
+}
+
+func (b *appendSortableBuffer) Reset() {
+	b.entries = b.entries[:0]
+	b.index = make(map[string]int)
+	b.size = 0
+}
+
+func (b *appendSortableBuffer) SizeLimit() int {
+	return b.sizeLimit
+}
+
+func (b *appendSortableBuffer) CheckFlushSize() bool {
+	return b.size >= b.sizeLimit
+}
+
+// oldestAppearsFirstBuffer is a Buffer for data sets with duplicate keys
+// where the first value Put under a key should win and later duplicates
+// should be discarded, preserving insertion order per key.
+type oldestAppearsFirstBuffer struct {
+	entries   []entry
+	index     map[string]struct{}
+	size      int
+	sizeLimit int
+	lessFunc  Less
+}
+
+// NewOldestAppearsFirstBuffer returns a BufferFactory producing buffers that
+// keep only the first value Put under a given key.
+func NewOldestAppearsFirstBuffer(lessFunc Less) BufferFactory {
+	return func(sizeLimit int) Buffer {
+		return &oldestAppearsFirstBuffer{
+			sizeLimit: sizeLimit,
+			lessFunc:  lessFunc,
+			index:     make(map[string]struct{}),
+		}
+	}
+}
+
+func (b *oldestAppearsFirstBuffer) Put(k, v []byte) {
+	if _, ok := b.index[string(k)]; ok {
+		return
+	}
+
+	e := entry{key: append([]byte(nil), k...), val: append([]byte(nil), v...)}
+	b.index[string(e.key)] = struct{}{}
+	b.entries = append(b.entries, e)
+	b.size += e.size()
+}
+
+func (b *oldestAppearsFirstBuffer) Get(i int, keyBuf, valBuf []byte) ([]byte, []byte) {
+	e := b.entries[i]
+	return append(keyBuf[:0], e.key...), append(valBuf[:0], e.val...)
+}
+
+func (b *oldestAppearsFirstBuffer) Len() int {
+	return len(b.entries)
+}
+
+func (b *oldestAppearsFirstBuffer) Sort() {
+	sort.Slice(b.entries, func(i, j int) bool {
+		return b.lessFunc(b.entries[i].key, b.entries[j].key)
+	})
+}
+
+func (b *oldestAppearsFirstBuffer) Reset() {
+	b.entries = b.entries[:0]
+	b.index = make(map[string]struct{})
+	b.size = 0
+}
+
+func (b *oldestAppearsFirstBuffer) SizeLimit() int {
+	return b.sizeLimit
+}
+
+func (b *oldestAppearsFirstBuffer) CheckFlushSize() bool {
+	return b.size >= b.sizeLimit
+}
+
+// writeRecord writes a key/value pair as a single record: the key
+// immediately followed by the value, with no extra framing. Callers that
+// only need whole-record sorting (the common case) pass the full record as
+// the key and leave the value empty, which keeps the on-disk layout byte
+// identical to the pre-Buffer chunked format.
+func writeRecord(w io.Writer, key, val []byte) error {
+	if _, err := w.Write(key); err != nil {
+		return err
+	}
+	if len(val) > 0 {
+		if _, err := w.Write(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
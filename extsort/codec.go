@@ -0,0 +1,140 @@
+package extsort
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// TmpFileCodec controls how key/value records are framed on temp files, so
+// that the same wire format is used when a spill file is written and later
+// re-read during the k-way merge.
+type TmpFileCodec interface {
+	// WriteEntry writes a single framed key/value record to w.
+	WriteEntry(w io.Writer, key, value []byte) error
+
+	// ReadEntry reads back a single framed key/value record from r.
+	ReadEntry(r io.Reader) (key, value []byte, err error)
+
+	// Wrap returns the stream that entries should actually be written to,
+	// allowing a codec to add stream-level processing (such as
+	// compression) around the raw temp file.
+	Wrap(w io.Writer) io.WriteCloser
+
+	// Unwrap returns the stream that entries should actually be read from,
+	// undoing whatever Wrap did.
+	Unwrap(r io.Reader) io.Reader
+}
+
+// framingCodec frames each entry as uvarint(len(key)) || key || uvarint(len(value)) || value.
+type framingCodec struct{}
+
+// NewFramingCodec returns a TmpFileCodec that length-prefixes keys and
+// values with varints and performs no compression.
+func NewFramingCodec() TmpFileCodec {
+	return framingCodec{}
+}
+
+func (framingCodec) Wrap(w io.Writer) io.WriteCloser {
+	return nopWriteCloser{w}
+}
+
+func (framingCodec) Unwrap(r io.Reader) io.Reader {
+	if _, ok := r.(io.ByteReader); ok {
+		return r
+	}
+	return bufio.NewReader(r)
+}
+
+func (framingCodec) WriteEntry(w io.Writer, key, value []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(lenBuf[:], uint64(len(key)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return fmt.Errorf("cannot write key length: %s", err)
+	}
+	if _, err := w.Write(key); err != nil {
+		return fmt.Errorf("cannot write key: %s", err)
+	}
+
+	n = binary.PutUvarint(lenBuf[:], uint64(len(value)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return fmt.Errorf("cannot write value length: %s", err)
+	}
+	if len(value) > 0 {
+		if _, err := w.Write(value); err != nil {
+			return fmt.Errorf("cannot write value: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (framingCodec) ReadEntry(r io.Reader) (key, value []byte, err error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		return nil, nil, fmt.Errorf("framingCodec.ReadEntry: reader must implement io.ByteReader, call Unwrap first")
+	}
+
+	keyLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, nil, fmt.Errorf("cannot read key: %s", err)
+	}
+
+	valLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read value length: %s", err)
+	}
+	if valLen > 0 {
+		value = make([]byte, valLen)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, nil, fmt.Errorf("cannot read value: %s", err)
+		}
+	}
+
+	return key, value, nil
+}
+
+// snappyCodec frames entries the same way framingCodec does, but streams
+// them through Snappy's block-based format so a partial read during the
+// k-way merge never requires decompressing the whole spill file.
+type snappyCodec struct {
+	framing TmpFileCodec
+}
+
+// NewSnappyCodec returns a TmpFileCodec that Snappy-compresses the framed
+// entry stream produced by NewFramingCodec.
+func NewSnappyCodec() TmpFileCodec {
+	return snappyCodec{framing: NewFramingCodec()}
+}
+
+func (c snappyCodec) Wrap(w io.Writer) io.WriteCloser {
+	return snappy.NewBufferedWriter(w)
+}
+
+func (c snappyCodec) Unwrap(r io.Reader) io.Reader {
+	return c.framing.Unwrap(snappy.NewReader(r))
+}
+
+func (c snappyCodec) WriteEntry(w io.Writer, key, value []byte) error {
+	return c.framing.WriteEntry(w, key, value)
+}
+
+func (c snappyCodec) ReadEntry(r io.Reader) (key, value []byte, err error) {
+	return c.framing.ReadEntry(r)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,54 @@
+package extsort
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFramingCodecRoundTrip(t *testing.T) {
+	testCodecRoundTrip(t, NewFramingCodec())
+}
+
+func TestSnappyCodecRoundTrip(t *testing.T) {
+	testCodecRoundTrip(t, NewSnappyCodec())
+}
+
+func testCodecRoundTrip(t *testing.T, codec TmpFileCodec) {
+	t.Helper()
+
+	entries := []entry{
+		{key: []byte("alpha"), val: []byte("1")},
+		{key: []byte("beta"), val: nil},
+		{key: []byte(""), val: []byte("empty-key")},
+	}
+
+	var buf bytes.Buffer
+	enc := codec.Wrap(&buf)
+	for _, e := range entries {
+		if err := codec.WriteEntry(enc, e.key, e.val); err != nil {
+			t.Fatalf("WriteEntry: %s", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	r := codec.Unwrap(&buf)
+	for i, want := range entries {
+		key, val, err := codec.ReadEntry(r)
+		if err != nil {
+			t.Fatalf("ReadEntry(%d): %s", i, err)
+		}
+		if !bytes.Equal(key, want.key) {
+			t.Fatalf("entry %d: got key %q, want %q", i, key, want.key)
+		}
+		if !bytes.Equal(val, want.val) {
+			t.Fatalf("entry %d: got val %q, want %q", i, val, want.val)
+		}
+	}
+
+	if _, _, err := codec.ReadEntry(r); err != io.EOF {
+		t.Fatalf("expected io.EOF after last entry, got %v", err)
+	}
+}
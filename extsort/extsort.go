@@ -2,115 +2,331 @@ package extsort
 
 import (
 	"bufio"
-	"container/heap"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
-	"sort"
-	"strconv"
+	"sync"
 
-	"github.com/mezk/external-sort/fileheap"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
 	memoryBufferFlushErr = "cannot flush memory buffer to temp file: %s"
 	defaultIoBufferSize  = 65536
+
+	// defaultMergeFanIn is the maximum number of spill files merged
+	// directly through a single fileheap; above this, Close performs a
+	// hierarchical merge instead.
+	defaultMergeFanIn = 16
 )
 
-// Chunk is a function that chunks data read from the given io.Reader into items for sorting.
+// Chunk is a function that chunks data read from the given io.Reader into
+// items for sorting. Resume drives a Chunk repeatedly against the same
+// underlying reader, so an implementation must not wrap r in its own
+// buffered reader on every call: doing so reads ahead into a buffer that is
+// then discarded when the call returns, silently dropping whatever it
+// speculatively read past the chunk it returned. Instead, mirror
+// TmpFileCodec.Unwrap: only wrap r if it doesn't already provide buffered
+// reads (check io.ByteReader), so repeated calls keep consuming the same
+// buffer rather than losing its read-ahead.
 type Chunk func(io.Reader) ([]byte, error)
 
 // Less is a function that compares two byte arrays (a1 and a2) and determines whether a2 is less than a2.
 type Less func(a1 []byte, a2 []byte) bool
 
-// sortEngine implements io.WriteCloser which sorts its output on writing.
-// Each []byte passed to the Write function is considered as a single item to sort.
+// Collector accumulates key/value records and, once closed, writes them out
+// in sorted order.
+type Collector interface {
+	// Collect adds a key/value record. Callers that only care about
+	// whole-record sorting can pass the whole record as k and leave v empty.
+	Collect(k, v []byte) error
+
+	// Flush blocks until every spill queued so far has been sorted and
+	// written to a temp file, surfacing the first error any of them hit.
+	Flush() error
+
+	// Close sorts and merges everything collected so far, writes the result
+	// to the configured output, and releases temp files and memory buffers.
+	Close() error
+}
+
+// Option configures a sortEngine created by New.
+type Option func(*sortEngine)
+
+// WithBufferFactory overrides the in-memory Buffer implementation used to
+// accumulate records before they are spilled to a temp file. The default is
+// NewSortableBuffer, which assumes keys are already unique.
+func WithBufferFactory(f BufferFactory) Option {
+	return func(se *sortEngine) {
+		se.bufferFactory = f
+	}
+}
+
+// WithCodec overrides the TmpFileCodec used to frame records written to and
+// read back from spill files. The default is NewFramingCodec, which applies
+// no compression.
+func WithCodec(codec TmpFileCodec) Option {
+	return func(se *sortEngine) {
+		se.codec = codec
+	}
+}
+
+// WithParallelism runs buffer sorting/spilling and, once there are more than
+// MergeFanIn spill files, the k-way merge itself across n worker goroutines.
+// The default, 1, keeps sortEngine fully sequential.
+func WithParallelism(n int) Option {
+	return func(se *sortEngine) {
+		se.parallelism = n
+	}
+}
+
+// WithMergeFanIn overrides how many spill files Close merges directly
+// through a single fileheap before falling back to a hierarchical merge.
+func WithMergeFanIn(n int) Option {
+	return func(se *sortEngine) {
+		se.mergeFanIn = n
+	}
+}
+
+// RunGenerator selects how sortEngine turns buffered records into sorted
+// runs before they are spilled.
+type RunGenerator int
+
+const (
+	// QuicksortRuns sorts each memory-full buffer independently, the
+	// default. Runs are never longer than one buffer.
+	QuicksortRuns RunGenerator = iota
+
+	// ReplacementSelectionRuns uses the replacement-selection algorithm to
+	// produce runs that are, on average, roughly twice as long as a single
+	// buffer, at the cost of a per-record heap push/pop instead of a
+	// per-buffer sort.
+	ReplacementSelectionRuns
+)
+
+// WithRunGenerator overrides how sortEngine builds sorted runs. The default
+// is QuicksortRuns.
+func WithRunGenerator(g RunGenerator) Option {
+	return func(se *sortEngine) {
+		se.runGenerator = g
+	}
+}
+
+// sortEngine implements Collector. Each key/value pair passed to Collect is
+// accumulated in an in-memory Buffer; once the buffer reports it is full, it
+// is handed off to a worker (or sorted inline when Parallelism is 1) that
+// sorts it and spills it to a temp file using codec. Close performs a k-way
+// merge of everything spilled, falling back to a hierarchical merge once
+// there are more spill files than MergeFanIn.
 type sortEngine struct {
-	memLimit       int
-	memUsed        int
-	tmpDir         string
-	chunkFunc      Chunk
-	lessFunc       Less
-	out            io.Writer
-	tmpFilesNumber int
-	memoryBuffer   [][]byte
-}
-
-// New returns a new io.WriteCloser that wraps out, chunks data into sortable
-// items using the given chunkFunc function, compares them using the given lessFunc function, and limits
-// the amount of memory (RAM) used to approximately memLimit.
-func New(out io.Writer, chunkFunc Chunk, lessFunc Less, memLimit int) (io.WriteCloser, error) {
-	tmpDir, tmpDirCreationErr := ioutil.TempDir("", "extsort_tmp_files")
-	if tmpDirCreationErr != nil {
-		return nil, fmt.Errorf("cannot create working directory to store temp files: %s", tmpDirCreationErr)
-	}
-
-	return &sortEngine{
-		memLimit:  memLimit,
-		tmpDir:    tmpDir,
-		chunkFunc: chunkFunc,
-		lessFunc:  lessFunc,
-		out:       out,
-	}, nil
+	memLimit      int
+	session       *session
+	lessFunc      Less
+	out           io.Writer
+	bufferFactory BufferFactory
+	buffer        Buffer
+	codec         TmpFileCodec
+	parallelism   int
+	mergeFanIn    int
+	runGenerator  RunGenerator
+	rs            *replacementSelection
+	rsWriter      *runWriter
+
+	mu         sync.Mutex
+	bufferPool sync.Pool
+	sem        chan struct{}
+	spillGroup *errgroup.Group
 }
 
-// Write writes bytes in memory buffer or flushes memory buffer to temp file if memory limit exceeded.
-func (se *sortEngine) Write(b []byte) (int, error) {
-	se.memoryBuffer = append(se.memoryBuffer, b)
-	se.memUsed += len(b)
+// New returns a new Collector that wraps out, compares items using the
+// given lessFunc function, and limits the amount of memory (RAM) used to
+// approximately memLimit. memLimit sizes each in-memory buffer; with
+// WithParallelism(n), up to n full buffers can be spilling while another one
+// fills, so memory use can reach about n+1 times memLimit.
+func New(out io.Writer, lessFunc Less, memLimit int, opts ...Option) (Collector, error) {
+	sess, sessionErr := newSession()
+	if sessionErr != nil {
+		return nil, sessionErr
+	}
 
-	if se.memUsed >= se.memLimit {
-		flushErr := se.flushToTempFile()
-		if flushErr != nil {
-			return 0, fmt.Errorf(memoryBufferFlushErr, flushErr)
-		}
+	se := &sortEngine{
+		memLimit:      memLimit,
+		session:       sess,
+		lessFunc:      lessFunc,
+		out:           out,
+		bufferFactory: NewSortableBuffer(lessFunc),
+		codec:         NewFramingCodec(),
+		parallelism:   1,
+		mergeFanIn:    defaultMergeFanIn,
+	}
+
+	for _, opt := range opts {
+		opt(se)
 	}
 
-	return len(b), nil
+	se.buffer = se.acquireBuffer()
+	se.spillGroup, _ = errgroup.WithContext(context.Background())
+	if se.parallelism > 1 {
+		se.sem = make(chan struct{}, se.parallelism)
+	}
+	if se.runGenerator == ReplacementSelectionRuns {
+		se.rs = newReplacementSelection(lessFunc, se.memLimit/defaultAvgRecordSize)
+	}
+
+	return se, nil
 }
 
-// Close closes io.WriteCloser and performs K-way merge of temp files
-// which represent sorted segments of the original large file.
-// It also cleans the directory with temp files and frees memory buffers.
-func (se *sortEngine) Close() error {
-	defer se.removeTempFiles()
+// Collect adds a key/value pair to the current memory buffer, rotating it
+// out for spilling if the buffer reports it has grown past its size limit.
+func (se *sortEngine) Collect(k, v []byte) error {
+	if se.rs != nil {
+		return se.collectReplacementSelection(k, v)
+	}
 
-	if se.memUsed > 0 {
-		// Memory buffer is not empty on close. Flush is required.
-		err := se.flushToTempFile()
-		if err != nil {
+	se.buffer.Put(k, v)
+
+	if se.buffer.CheckFlushSize() {
+		if err := se.rotateBuffer(); err != nil {
 			return fmt.Errorf(memoryBufferFlushErr, err)
 		}
 	}
 
-	// Free memory buffer
-	se.memoryBuffer = nil
+	return nil
+}
 
-	files := make(map[int]*bufio.Reader, se.tmpFilesNumber)
-	for i := 0; i < se.tmpFilesNumber; i++ {
-		file, openTmpFileErr := os.OpenFile(filepath.Join(se.tmpDir, strconv.Itoa(i)), os.O_RDONLY, 0)
-		if openTmpFileErr != nil {
-			return fmt.Errorf("cannot open temp file: %s\n", openTmpFileErr)
+// collectReplacementSelection feeds k/v through the replacement-selection
+// heap. Every record the heap pops is streamed straight to the run in
+// progress's spill file, so a run's memory cost stays bounded by the heap's
+// capacity no matter how long the run grows on well-ordered input; only the
+// run boundary (runDone) triggers closing/committing the spill file.
+func (se *sortEngine) collectReplacementSelection(k, v []byte) error {
+	popped, popOk, runDone := se.rs.Add(k, v)
+	if popOk {
+		if err := se.appendReplacementEntry(popped); err != nil {
+			return err
 		}
-		defer file.Close()
-		files[i] = bufio.NewReaderSize(file, defaultIoBufferSize)
 	}
+	if runDone {
+		if err := se.finishReplacementRun(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if se.tmpFilesNumber == 1 {
-		// There is only one temp file with sorted data
-		_, copyErr := io.Copy(se.out, files[0])
-		if copyErr != nil {
-			return fmt.Errorf("cannot write temp file content to output: %s\n", copyErr)
+// appendReplacementEntry streams e to the spill file for the replacement-
+// selection run currently in progress, opening a new one first if this is
+// the run's first record.
+func (se *sortEngine) appendReplacementEntry(e entry) error {
+	if se.rsWriter == nil {
+		rw, err := newRunWriter(se.session, se.codec, se.nextTmpFileIdx())
+		if err != nil {
+			return fmt.Errorf(memoryBufferFlushErr, err)
 		}
-	} else {
-		sortErr := se.sort(files)
-		if sortErr != nil {
-			return fmt.Errorf("cannot sort temp files: %s\n", sortErr)
+		se.rsWriter = rw
+	}
+
+	if err := se.rsWriter.writeEntry(e.key, e.val); err != nil {
+		return fmt.Errorf(memoryBufferFlushErr, err)
+	}
+
+	return nil
+}
+
+// finishReplacementRun closes and commits the run in progress's spill file,
+// if one is open. It is a no-op if no record has been streamed to it yet.
+func (se *sortEngine) finishReplacementRun() error {
+	if se.rsWriter == nil {
+		return nil
+	}
+
+	rw := se.rsWriter
+	se.rsWriter = nil
+
+	info, err := rw.close()
+	if err != nil {
+		return fmt.Errorf(memoryBufferFlushErr, err)
+	}
+
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.session.commitRun(info)
+}
+
+// Flush waits for every spill queued so far to finish.
+func (se *sortEngine) Flush() error {
+	return se.spillGroup.Wait()
+}
+
+// rotateBuffer swaps in a fresh buffer from the pool and hands the full one
+// off to be sorted and spilled, either inline (Parallelism == 1) or on a
+// worker goroutine bounded by sem, so Collect can keep filling the fresh
+// buffer without waiting for the spill to finish.
+func (se *sortEngine) rotateBuffer() error {
+	full := se.buffer
+	idx := se.nextTmpFileIdx()
+	se.buffer = se.acquireBuffer()
+
+	if se.parallelism <= 1 {
+		return se.spillBuffer(idx, full)
+	}
+
+	se.sem <- struct{}{}
+	se.spillGroup.Go(func() error {
+		defer func() { <-se.sem }()
+		return se.spillBuffer(idx, full)
+	})
+
+	return nil
+}
+
+func (se *sortEngine) nextTmpFileIdx() int {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	return se.session.nextRunIdx()
+}
+
+func (se *sortEngine) acquireBuffer() Buffer {
+	if b, ok := se.bufferPool.Get().(Buffer); ok {
+		return b
+	}
+	return se.bufferFactory(se.memLimit)
+}
+
+func (se *sortEngine) releaseBuffer(b Buffer) {
+	b.Reset()
+	se.bufferPool.Put(b)
+}
+
+// Close closes the Collector and performs K-way merge of temp files
+// which represent sorted segments of the original large file.
+// It also cleans the directory with temp files and frees memory buffers.
+// It is a thin wrapper over Iterator: it pulls every merged record and
+// writes it straight to the configured output.
+func (se *sortEngine) Close() error {
+	defer se.removeTempFiles()
+
+	it, iterErr := se.Iterator()
+	if iterErr != nil {
+		return iterErr
+	}
+	defer it.Close()
+
+	for it.Next() {
+		if writeErr := writeRecord(se.out, it.Key(), it.Value()); writeErr != nil {
+			return fmt.Errorf("cannot write merged entry to output: %s\n", writeErr)
 		}
 	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("cannot merge temp files: %s\n", err)
+	}
 
+	return se.closeOut()
+}
+
+func (se *sortEngine) closeOut() error {
 	switch c := se.out.(type) {
 	case io.Closer:
 		return c.Close()
@@ -120,129 +336,287 @@ func (se *sortEngine) Close() error {
 	}
 }
 
-func (se *sortEngine) flushToTempFile() error {
-	// Sort memory buffer content using lessFunc function
-	sort.Sort(&fileChunkInMemoryRepresentation{se.memoryBuffer, se.lessFunc})
+// spillBuffer sorts buf, writes it to a new spill file, and commits it to
+// the session's manifest so the run survives a crash.
+func (se *sortEngine) spillBuffer(idx int, buf Buffer) error {
+	defer se.releaseBuffer(buf)
+
+	// Sort the buffer content using its own Less function
+	buf.Sort()
 
+	info, writeErr := writeRunFile(se.session, se.codec, idx, buf)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	return se.session.commitRun(info)
+}
+
+// writeRunFile writes buf's sorted content to a new spill file in sess and
+// returns the runInfo the manifest should record for it.
+func writeRunFile(sess *session, codec TmpFileCodec, idx int, buf Buffer) (runInfo, error) {
 	file, tmpFileCreationErr := os.OpenFile(
-		filepath.Join(se.tmpDir, strconv.Itoa(se.tmpFilesNumber)),
+		sess.runPath(idx),
 		os.O_CREATE|os.O_WRONLY, 0644)
 	if tmpFileCreationErr != nil {
-		return fmt.Errorf("cannot create temp file to flush memory buffer: %s\n", tmpFileCreationErr)
+		return runInfo{}, fmt.Errorf("cannot create temp file to flush memory buffer: %s\n", tmpFileCreationErr)
 	}
 	defer file.Close()
 
 	out := bufio.NewWriterSize(file, defaultIoBufferSize)
-	for _, bytes := range se.memoryBuffer {
-		_, writeMemoryBufferErr := out.Write(bytes)
-		if writeMemoryBufferErr != nil {
-			return fmt.Errorf("cannot write to temp file: %s\n", writeMemoryBufferErr)
+	encoder := codec.Wrap(out)
+
+	var keyBuf, valBuf []byte
+	var minKey, maxKey []byte
+	for i := 0; i < buf.Len(); i++ {
+		keyBuf, valBuf = buf.Get(i, keyBuf, valBuf)
+		if writeErr := codec.WriteEntry(encoder, keyBuf, valBuf); writeErr != nil {
+			return runInfo{}, fmt.Errorf("cannot write to temp file: %s\n", writeErr)
+		}
+		if i == 0 {
+			minKey = append([]byte(nil), keyBuf...)
 		}
+		maxKey = append(maxKey[:0], keyBuf...)
+	}
+
+	if closeErr := encoder.Close(); closeErr != nil {
+		return runInfo{}, fmt.Errorf("cannot close temp file encoder: %s\n", closeErr)
+	}
+	if flushErr := out.Flush(); flushErr != nil {
+		return runInfo{}, flushErr
 	}
+	if syncErr := file.Sync(); syncErr != nil {
+		return runInfo{}, fmt.Errorf("cannot sync temp file: %s\n", syncErr)
+	}
+
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		return runInfo{}, fmt.Errorf("cannot stat temp file: %s\n", statErr)
+	}
+
+	return runInfo{
+		Idx:          idx,
+		Records:      buf.Len(),
+		Bytes:        stat.Size(),
+		MinKey:       minKey,
+		MaxKey:       maxKey,
+		CodecVersion: manifestCodecVersion,
+	}, nil
+}
+
+// runWriter streams a run's entries to a new spill file one at a time, so
+// replacementSelection can report a completed run without ever holding it
+// in memory as a whole. It writes the same framed layout writeRunFile does,
+// just incrementally instead of from an already-built Buffer.
+type runWriter struct {
+	idx   int
+	file  *os.File
+	out   *bufio.Writer
+	enc   io.WriteCloser
+	codec TmpFileCodec
+
+	records        int
+	minKey, maxKey []byte
+}
 
-	flushToTempFileErr := out.Flush()
-	if flushToTempFileErr != nil {
-		return fmt.Errorf("cannot flush to temp file: %s\n", flushToTempFileErr)
+// newRunWriter creates a new spill file in sess at idx and returns a
+// runWriter ready to stream entries to it through codec.
+func newRunWriter(sess *session, codec TmpFileCodec, idx int) (*runWriter, error) {
+	file, err := os.OpenFile(sess.runPath(idx), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temp file to flush replacement-selection run: %s\n", err)
 	}
 
-	se.tmpFilesNumber++
-	se.memUsed = 0
+	out := bufio.NewWriterSize(file, defaultIoBufferSize)
+	return &runWriter{idx: idx, file: file, out: out, enc: codec.Wrap(out), codec: codec}, nil
+}
 
-	// Reallocate memory buffer
-	se.memoryBuffer = make([][]byte, 0, len(se.memoryBuffer))
+// writeEntry appends key/val to the run.
+func (rw *runWriter) writeEntry(key, val []byte) error {
+	if err := rw.codec.WriteEntry(rw.enc, key, val); err != nil {
+		return fmt.Errorf("cannot write to temp file: %s\n", err)
+	}
+
+	if rw.records == 0 {
+		rw.minKey = append([]byte(nil), key...)
+	}
+	rw.maxKey = append(rw.maxKey[:0], key...)
+	rw.records++
 
 	return nil
 }
 
-func (se *sortEngine) sort(files map[int]*bufio.Reader) error {
-	defer se.removeTempFiles()
+// close flushes and fsyncs the spill file and returns the runInfo the
+// manifest should record for it.
+func (rw *runWriter) close() (runInfo, error) {
+	defer rw.file.Close()
 
-	fileHeap := fileheap.NewHeap(se.lessFunc)
-
-	memLimitPerFile := se.memLimit / (se.tmpFilesNumber + 1)
-
-	fillHeap := func() error {
-		for i := 0; i < len(files); i++ {
-			file := files[i]
-			readBytes := 0
-			for {
-				b, chunkFileErr := se.chunkFunc(file)
-				if chunkFileErr == io.EOF {
-					delete(files, i)
-					break
-				}
-				if chunkFileErr != nil {
-					return fmt.Errorf("cannot chunk file: %s\n", chunkFileErr)
-				}
-				readBytes += len(b)
-				heap.Push(fileHeap, fileheap.NewEntry(i, b))
-				if readBytes >= memLimitPerFile {
-					break
-				}
-			}
-		}
+	if err := rw.enc.Close(); err != nil {
+		return runInfo{}, fmt.Errorf("cannot close temp file encoder: %s\n", err)
+	}
+	if err := rw.out.Flush(); err != nil {
+		return runInfo{}, err
+	}
+	if err := rw.file.Sync(); err != nil {
+		return runInfo{}, fmt.Errorf("cannot sync temp file: %s\n", err)
+	}
 
-		return nil
+	stat, err := rw.file.Stat()
+	if err != nil {
+		return runInfo{}, fmt.Errorf("cannot stat temp file: %s\n", err)
 	}
 
-	for {
-		if fileHeap.Len() == 0 {
-			fillHeapErr := fillHeap()
-			if fillHeapErr != nil {
-				return fmt.Errorf("cannot fill heap: %s\n", fillHeapErr)
-			}
-		}
-		if fileHeap.Len() == 0 {
-			// Nothing left to sort
-			break
+	return runInfo{
+		Idx:          rw.idx,
+		Records:      rw.records,
+		Bytes:        stat.Size(),
+		MinKey:       rw.minKey,
+		MaxKey:       rw.maxKey,
+		CodecVersion: manifestCodecVersion,
+	}, nil
+}
+
+// openRunFile opens a spill file previously written to sess by idx.
+func openRunFile(sess *session, idx int) (*os.File, error) {
+	file, err := os.OpenFile(sess.runPath(idx), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open temp file: %s\n", err)
+	}
+	return file, nil
+}
+
+func (se *sortEngine) openSpillFiles(from, to int) ([]io.Reader, func(), error) {
+	readers := make([]io.Reader, 0, to-from)
+	files := make([]*os.File, 0, to-from)
+
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
 		}
+	}
 
-		heapEntry := heap.Pop(fileHeap).(*fileheap.Entry)
-		_, writeErr := se.out.Write(heapEntry.Data)
-		if writeErr != nil {
-			return fmt.Errorf("cannot write heap entry data to result output: %s\n", writeErr)
+	for i := from; i < to; i++ {
+		file, openErr := openRunFile(se.session, i)
+		if openErr != nil {
+			closeAll()
+			return nil, nil, openErr
 		}
+		files = append(files, file)
+		readers = append(readers, se.codec.Unwrap(bufio.NewReaderSize(file, defaultIoBufferSize)))
+	}
 
-		// Read next chunk of data from heap top file
-		file := files[heapEntry.FileIdx]
-		if file != nil {
-			b, err := se.chunkFunc(file)
-			if err == io.EOF {
-				delete(files, heapEntry.FileIdx)
-				continue
-			}
+	return readers, closeAll, nil
+}
+
+// resolveMergeReaders returns the final set of readers a single k-way merge
+// should run over. When there are more than se.mergeFanIn readers, it first
+// merges disjoint groups of at most se.mergeFanIn readers into intermediate
+// spill files, up to se.parallelism groups at a time. Grouping happens only
+// once: the final merge takes one intermediate run per group, so it fans in
+// more than se.mergeFanIn readers when there are more than se.mergeFanIn
+// squared of them.
+// The returned func closes whatever intermediate file handles were opened.
+func (se *sortEngine) resolveMergeReaders(readers []io.Reader) ([]io.Reader, func(), error) {
+	noop := func() {}
+
+	if len(readers) <= se.mergeFanIn {
+		return readers, noop, nil
+	}
+
+	groups := chunkReaders(readers, se.mergeFanIn)
+
+	g, _ := errgroup.WithContext(context.Background())
+	sem := make(chan struct{}, se.parallelism)
+	intermediateIdx := make([]int, len(groups))
+
+	for i, group := range groups {
+		i, group := i, group
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			idx, err := se.mergeIntoIntermediateFile(group)
 			if err != nil {
-				return fmt.Errorf("error replacing entry on heap: %s\n", err)
+				return err
 			}
-			heap.Push(fileHeap, fileheap.NewEntry(heapEntry.FileIdx, b))
+			intermediateIdx[i] = idx
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, noop, fmt.Errorf("cannot merge intermediate runs: %s\n", err)
+	}
+
+	intermediateReaders := make([]io.Reader, 0, len(intermediateIdx))
+	files := make([]*os.File, 0, len(intermediateIdx))
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
 		}
 	}
 
-	return nil
+	for _, idx := range intermediateIdx {
+		file, openErr := openRunFile(se.session, idx)
+		if openErr != nil {
+			closeAll()
+			return nil, noop, fmt.Errorf("cannot open intermediate run: %s\n", openErr)
+		}
+		files = append(files, file)
+		intermediateReaders = append(intermediateReaders, se.codec.Unwrap(bufio.NewReaderSize(file, defaultIoBufferSize)))
+	}
+
+	return intermediateReaders, closeAll, nil
 }
 
-func (se *sortEngine) removeTempFiles() {
-	fmt.Printf("Removing temp files in %s\n", se.tmpDir)
-	err := os.RemoveAll(se.tmpDir)
-	if err != nil {
-		panic(fmt.Errorf("cannot remove temp files in %s: %s\n", se.tmpDir, err))
+// mergeIntoIntermediateFile merges group into a brand new spill file (framed
+// with se.codec, so it can be re-read the same way any other spill file is)
+// and returns that file's index.
+func (se *sortEngine) mergeIntoIntermediateFile(group []io.Reader) (int, error) {
+	idx := se.nextTmpFileIdx()
+
+	file, createErr := os.OpenFile(
+		se.session.runPath(idx),
+		os.O_CREATE|os.O_WRONLY, 0644)
+	if createErr != nil {
+		return 0, fmt.Errorf("cannot create intermediate run file: %s\n", createErr)
 	}
-	fmt.Println("Successfully finished temp files removal process")
-}
+	defer file.Close()
 
-type fileChunkInMemoryRepresentation struct {
-	memoryBuffer [][]byte
-	lessFunc     func(a []byte, b []byte) bool
-}
+	out := bufio.NewWriterSize(file, defaultIoBufferSize)
+	encoder := se.codec.Wrap(out)
 
-func (fc *fileChunkInMemoryRepresentation) Len() int {
-	return len(fc.memoryBuffer)
+	mi := newMergeIterator(group, se.codec, se.lessFunc, se.memLimit)
+	for mi.Next() {
+		if err := se.codec.WriteEntry(encoder, mi.Key(), mi.Value()); err != nil {
+			return 0, fmt.Errorf("cannot write intermediate run entry: %s\n", err)
+		}
+	}
+	if err := mi.Err(); err != nil {
+		return 0, err
+	}
+
+	if closeErr := encoder.Close(); closeErr != nil {
+		return 0, fmt.Errorf("cannot close intermediate run encoder: %s\n", closeErr)
+	}
+
+	return idx, out.Flush()
 }
 
-func (fc *fileChunkInMemoryRepresentation) Less(i, j int) bool {
-	return fc.lessFunc(fc.memoryBuffer[i], fc.memoryBuffer[j])
+// chunkReaders splits readers into consecutive groups of at most size
+// elements each.
+func chunkReaders(readers []io.Reader, size int) [][]io.Reader {
+	var groups [][]io.Reader
+	for size < len(readers) {
+		readers, groups = readers[size:], append(groups, readers[0:size:size])
+	}
+	return append(groups, readers)
 }
 
-func (fc *fileChunkInMemoryRepresentation) Swap(i, j int) {
-	fc.memoryBuffer[i], fc.memoryBuffer[j] = fc.memoryBuffer[j], fc.memoryBuffer[i]
+func (se *sortEngine) removeTempFiles() {
+	fmt.Printf("Removing temp files in %s\n", se.session.dir)
+	if err := se.session.remove(); err != nil {
+		panic(fmt.Errorf("cannot remove temp files in %s: %s\n", se.session.dir, err))
+	}
+	fmt.Println("Successfully finished temp files removal process")
 }
@@ -0,0 +1,64 @@
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mezk/external-sort/generator"
+)
+
+const (
+	benchLinesNumber = 1000000
+	benchLineLength  = 30
+	benchMemLimit    = 4 * 1024 * 1024
+)
+
+func benchmarkSort(b *testing.B, parallelism int) {
+	var input bytes.Buffer
+	if err := generator.New(&input, "", benchLinesNumber, benchLineLength, '\n').Generate(); err != nil {
+		b.Fatalf("cannot generate benchmark input: %s", err)
+	}
+	inputBytes := input.Bytes()
+
+	lessFunc := func(a1, a2 []byte) bool {
+		return bytes.Compare(a1, a2) < 0
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		engine, err := New(ioutil.Discard, lessFunc, benchMemLimit, WithParallelism(parallelism))
+		if err != nil {
+			b.Fatalf("cannot create sort engine: %s", err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(inputBytes))
+		for scanner.Scan() {
+			line := append(append([]byte(nil), scanner.Bytes()...), '\n')
+			if err := engine.Collect(line, nil); err != nil {
+				b.Fatalf("cannot collect line: %s", err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			b.Fatalf("cannot scan benchmark input: %s", err)
+		}
+
+		if err := engine.Close(); err != nil {
+			b.Fatalf("cannot close sort engine: %s", err)
+		}
+	}
+}
+
+func BenchmarkSortSerial(b *testing.B) {
+	benchmarkSort(b, 1)
+}
+
+func BenchmarkSortParallel4(b *testing.B) {
+	benchmarkSort(b, 4)
+}
+
+func BenchmarkSortParallel8(b *testing.B) {
+	benchmarkSort(b, 8)
+}
@@ -0,0 +1,276 @@
+package extsort
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mezk/external-sort/fileheap"
+)
+
+// reopenedDirFillSize bounds how much of a reopened spill file mergeIterator
+// reads into the heap per fill pass when the original memLimit that produced
+// it is unknown, as is the case for OpenSorted.
+const reopenedDirFillSize = 1 << 20
+
+// Iterator pulls merged key/value records out in sorted order.
+type Iterator interface {
+	// Next advances to the next record, returning false once the merge is
+	// exhausted or an error occurred (check Err in that case).
+	Next() bool
+
+	// Key returns the current record's key. Valid until the next Next call.
+	Key() []byte
+
+	// Value returns the current record's value. Valid until the next Next call.
+	Value() []byte
+
+	// Err returns the first error encountered while iterating, if any.
+	Err() error
+
+	// Close releases the resources backing the iterator (open spill files).
+	// It does not remove the underlying spill directory.
+	Close() error
+}
+
+// Iterator returns an Iterator that pulls the merged, sorted result of
+// everything collected so far. Close's write-to-out behavior is a thin
+// wrapper over this.
+func (se *sortEngine) Iterator() (Iterator, error) {
+	if se.parallelism <= 1 && se.buffer.Len() > 0 && se.session.m.NextRunIdx == 0 {
+		// Everything fits in memory: iterate the buffer directly, skipping
+		// the temp directory entirely.
+		se.buffer.Sort()
+		return &bufferIterator{buf: se.buffer}, nil
+	}
+
+	if se.buffer.Len() > 0 {
+		if err := se.rotateBuffer(); err != nil {
+			return nil, fmt.Errorf(memoryBufferFlushErr, err)
+		}
+	}
+	if se.rs != nil {
+		if err := se.flushReplacementSelection(); err != nil {
+			return nil, fmt.Errorf(memoryBufferFlushErr, err)
+		}
+	}
+	if err := se.Flush(); err != nil {
+		return nil, fmt.Errorf("cannot flush outstanding spills: %s\n", err)
+	}
+
+	readers, closeSpills, err := se.openSpillFiles(0, se.session.m.NextRunIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	finalReaders, closeIntermediate, err := se.resolveMergeReaders(readers)
+	if err != nil {
+		closeSpills()
+		return nil, err
+	}
+
+	mi := newMergeIterator(finalReaders, se.codec, se.lessFunc, se.memLimit)
+	return &spillIterator{
+		mergeIterator: mi,
+		closeFn: func() error {
+			closeIntermediate()
+			closeSpills()
+			return nil
+		},
+	}, nil
+}
+
+// flushReplacementSelection spills every run still held by se.rs (the run in
+// progress on the active heap, plus the run-in-waiting on the next heap),
+// streaming each one's entries to its spill file in sorted order rather
+// than materializing it as a slice first.
+func (se *sortEngine) flushReplacementSelection() error {
+	for {
+		e, ok := se.rs.drainActive()
+		if !ok {
+			break
+		}
+		if err := se.appendReplacementEntry(e); err != nil {
+			return err
+		}
+	}
+	if err := se.finishReplacementRun(); err != nil {
+		return err
+	}
+
+	for {
+		e, ok := se.rs.drainNext()
+		if !ok {
+			break
+		}
+		if err := se.appendReplacementEntry(e); err != nil {
+			return err
+		}
+	}
+	return se.finishReplacementRun()
+}
+
+// OpenSorted reopens a session directory previously written by a sortEngine
+// using codec and returns an Iterator that k-way merges its committed runs,
+// so sort/merge stages can be chained without materializing an intermediate
+// merged file. It reads the session's MANIFEST (the same one Resume and
+// DryRun use) to find the runs rather than listing the directory, since a
+// session directory also holds MANIFEST-<gen> and CURRENT bookkeeping files
+// that aren't framed record streams.
+func OpenSorted(dir string, codec TmpFileCodec, less Less) (Iterator, error) {
+	sess, err := openSession(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open session in %s: %s\n", dir, err)
+	}
+
+	var files []*os.File
+	closeAll := func() error {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil
+	}
+
+	readers := make([]io.Reader, 0, len(sess.m.Runs))
+	for _, run := range sess.m.Runs {
+		file, openErr := openRunFile(sess, run.Idx)
+		if openErr != nil {
+			closeAll()
+			return nil, openErr
+		}
+		files = append(files, file)
+		readers = append(readers, codec.Unwrap(bufio.NewReaderSize(file, defaultIoBufferSize)))
+	}
+
+	mi := newMergeIterator(readers, codec, less, reopenedDirFillSize*(len(readers)+1))
+	return &spillIterator{mergeIterator: mi, closeFn: closeAll}, nil
+}
+
+// bufferIterator iterates an already-sorted in-memory Buffer.
+type bufferIterator struct {
+	buf      Buffer
+	idx      int
+	key, val []byte
+}
+
+func (it *bufferIterator) Next() bool {
+	if it.idx >= it.buf.Len() {
+		return false
+	}
+	it.key, it.val = it.buf.Get(it.idx, it.key[:0], it.val[:0])
+	it.idx++
+	return true
+}
+
+func (it *bufferIterator) Key() []byte   { return it.key }
+func (it *bufferIterator) Value() []byte { return it.val }
+func (it *bufferIterator) Err() error    { return nil }
+func (it *bufferIterator) Close() error  { return nil }
+
+// spillIterator is a mergeIterator over spill files, plus a hook to close
+// the file handles backing it once the caller is done.
+type spillIterator struct {
+	*mergeIterator
+	closeFn func() error
+}
+
+func (it *spillIterator) Close() error {
+	return it.closeFn()
+}
+
+// mergeIterator pulls entries out of readers in sorted order via the same
+// fileheap k-way merge sortEngine has always used, one Next call at a time
+// instead of driving the whole merge to completion up front.
+type mergeIterator struct {
+	fileHeap        *fileheap.FileHeap
+	codec           TmpFileCodec
+	remaining       map[int]io.Reader
+	numReaders      int
+	memLimitPerFile int
+	key, val        []byte
+	err             error
+}
+
+func newMergeIterator(readers []io.Reader, codec TmpFileCodec, lessFunc Less, memLimit int) *mergeIterator {
+	remaining := make(map[int]io.Reader, len(readers))
+	for i, r := range readers {
+		remaining[i] = r
+	}
+
+	memLimitPerFile := memLimit / (len(readers) + 1)
+
+	return &mergeIterator{
+		fileHeap:        fileheap.NewHeap(lessFunc),
+		codec:           codec,
+		remaining:       remaining,
+		numReaders:      len(readers),
+		memLimitPerFile: memLimitPerFile,
+	}
+}
+
+func (it *mergeIterator) fillHeap() {
+	for i := 0; i < it.numReaders; i++ {
+		file, ok := it.remaining[i]
+		if !ok {
+			continue
+		}
+
+		readBytes := 0
+		for {
+			key, val, readErr := it.codec.ReadEntry(file)
+			if readErr == io.EOF {
+				delete(it.remaining, i)
+				break
+			}
+			if readErr != nil {
+				it.err = fmt.Errorf("cannot read entry: %s\n", readErr)
+				return
+			}
+			readBytes += len(key) + len(val)
+			heap.Push(it.fileHeap, fileheap.NewEntry(i, key, val))
+			if readBytes >= it.memLimitPerFile {
+				break
+			}
+		}
+	}
+}
+
+func (it *mergeIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.fileHeap.Len() == 0 {
+		it.fillHeap()
+		if it.err != nil {
+			return false
+		}
+	}
+	if it.fileHeap.Len() == 0 {
+		return false
+	}
+
+	entry := heap.Pop(it.fileHeap).(*fileheap.Entry)
+	it.key, it.val = entry.Key, entry.Val
+
+	if file, ok := it.remaining[entry.FileIdx]; ok {
+		key, val, err := it.codec.ReadEntry(file)
+		switch {
+		case err == io.EOF:
+			delete(it.remaining, entry.FileIdx)
+		case err != nil:
+			it.err = fmt.Errorf("error replacing entry on heap: %s\n", err)
+		default:
+			heap.Push(it.fileHeap, fileheap.NewEntry(entry.FileIdx, key, val))
+		}
+	}
+
+	return true
+}
+
+func (it *mergeIterator) Key() []byte   { return it.key }
+func (it *mergeIterator) Value() []byte { return it.val }
+func (it *mergeIterator) Err() error    { return it.err }
+func (it *mergeIterator) Close() error  { return nil }
@@ -0,0 +1,100 @@
+package extsort
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func bytesLess(a, b []byte) bool {
+	return bytes.Compare(a, b) < 0
+}
+
+func TestMergeIteratorSortedOutput(t *testing.T) {
+	codec := NewFramingCodec()
+
+	write := func(kvs ...string) io.Reader {
+		var buf bytes.Buffer
+		enc := codec.Wrap(&buf)
+		for i := 0; i < len(kvs); i += 2 {
+			if err := codec.WriteEntry(enc, []byte(kvs[i]), []byte(kvs[i+1])); err != nil {
+				t.Fatalf("WriteEntry: %s", err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+		return codec.Unwrap(&buf)
+	}
+
+	readers := []io.Reader{
+		write("b", "2", "d", "4"),
+		write("a", "1", "c", "3"),
+	}
+
+	mi := newMergeIterator(readers, codec, bytesLess, 1<<20)
+
+	var got []string
+	for mi.Next() {
+		got = append(got, string(mi.Key())+string(mi.Value()))
+	}
+	if err := mi.Err(); err != nil {
+		t.Fatalf("merge error: %s", err)
+	}
+
+	want := []string{"a1", "b2", "c3", "d4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestOpenSortedRoundTrip(t *testing.T) {
+	engine, err := New(ioutil.Discard, bytesLess, 64)
+	if err != nil {
+		t.Fatalf("cannot create sort engine: %s", err)
+	}
+	se := engine.(*sortEngine)
+
+	input := []string{"d", "b", "a", "c", "f", "e"}
+	for _, k := range input {
+		if err := se.Collect([]byte(k), nil); err != nil {
+			t.Fatalf("cannot collect %q: %s", k, err)
+		}
+	}
+
+	it, err := se.Iterator()
+	if err != nil {
+		t.Fatalf("cannot build iterator: %s", err)
+	}
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterator error: %s", err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("cannot close iterator: %s", err)
+	}
+	defer os.RemoveAll(se.session.dir)
+
+	reopened, err := OpenSorted(se.session.dir, se.codec, bytesLess)
+	if err != nil {
+		t.Fatalf("OpenSorted: %s", err)
+	}
+	defer reopened.Close()
+
+	var got []string
+	for reopened.Next() {
+		got = append(got, string(reopened.Key()))
+	}
+	if err := reopened.Err(); err != nil {
+		t.Fatalf("reopened iterator error: %s", err)
+	}
+
+	want := []string{"a", "b", "c", "d", "e", "f"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+package extsort
+
+import (
+	"container/heap"
+)
+
+// defaultAvgRecordSize sizes the replacement-selection heap when the caller
+// hasn't measured their own average record size: memLimit / defaultAvgRecordSize
+// records are kept in the heap at once.
+const defaultAvgRecordSize = 64
+
+// entryHeap is a container/heap.Interface min-heap of entries, ordered by
+// lessFunc over their keys.
+type entryHeap struct {
+	entries  []entry
+	lessFunc Less
+}
+
+func (h *entryHeap) Len() int { return len(h.entries) }
+
+func (h *entryHeap) Less(i, j int) bool {
+	return h.lessFunc(h.entries[i].key, h.entries[j].key)
+}
+
+func (h *entryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(entry))
+}
+
+func (h *entryHeap) Pop() interface{} {
+	n := len(h.entries)
+	e := h.entries[n-1]
+	h.entries = h.entries[:n-1]
+	return e
+}
+
+// replacementSelection builds sorted runs longer than a single memory-full
+// of records by keeping a min-heap of records "active" for the run
+// currently being written, and a second heap of records that arrived too
+// small to extend it, to be sorted into a run of their own. Only the two
+// heaps, each bounded by capacity, are ever held in memory: a completed run
+// is reported one popped record at a time as Add is called, rather than
+// accumulated into a run-sized slice, so a long (or unbounded, for
+// already-sorted input) run never grows memory past the heap capacity.
+//
+// On average this produces runs roughly twice the length of a plain
+// quicksort-per-block, since a majority of newly read records are still
+// large enough to extend the run in progress.
+type replacementSelection struct {
+	active   *entryHeap
+	next     *entryHeap
+	capacity int
+	less     Less
+}
+
+// newReplacementSelection returns a replacementSelection whose active heap
+// holds up to capacity records before it starts producing runs.
+func newReplacementSelection(lessFunc Less, capacity int) *replacementSelection {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &replacementSelection{
+		active:   &entryHeap{lessFunc: lessFunc},
+		next:     &entryHeap{lessFunc: lessFunc},
+		capacity: capacity,
+		less:     lessFunc,
+	}
+}
+
+// Add feeds one record through the replacement-selection state machine.
+// Whenever this call pops a record off the active heap, it is returned as
+// (popped, true) so the caller can stream it straight to the current run's
+// spill file instead of buffering it; runDone additionally reports that the
+// popped record was the last one in that run (the active heap emptied and
+// the next-run region took its place), so the caller should close/rotate
+// the spill file. If Add only absorbed e into a heap, it returns
+// (entry{}, false, false).
+func (rs *replacementSelection) Add(k, v []byte) (popped entry, popOk bool, runDone bool) {
+	e := entry{key: append([]byte(nil), k...), val: append([]byte(nil), v...)}
+
+	if rs.active.Len() < rs.capacity && rs.next.Len() == 0 {
+		// Still warming up: just seed the active heap with the first
+		// RAM-full of records.
+		heap.Push(rs.active, e)
+		return entry{}, false, false
+	}
+
+	if rs.active.Len() == 0 {
+		// The active heap is between runs; e can't extend the run that just
+		// finished, so it goes straight to the next one.
+		heap.Push(rs.next, e)
+		return entry{}, false, false
+	}
+
+	x := heap.Pop(rs.active).(entry)
+
+	if rs.less(x.key, e.key) {
+		// e can still extend the run in progress.
+		heap.Push(rs.active, e)
+	} else {
+		// e is smaller than the last record written to the current run, so
+		// it belongs to the next run instead.
+		heap.Push(rs.next, e)
+	}
+
+	if rs.active.Len() == 0 {
+		rs.active, rs.next = rs.next, rs.active
+		return x, true, true
+	}
+
+	return x, true, false
+}
+
+// drainActive pops and returns the smallest record still held by the active
+// heap, for use once there is no more input and the run in progress must be
+// finished off one record at a time.
+func (rs *replacementSelection) drainActive() (entry, bool) {
+	return drainHeap(rs.active)
+}
+
+// drainNext pops and returns the smallest record still held by the
+// next-run region, for use once there is no more input and it must be
+// flushed out as a run of its own.
+func (rs *replacementSelection) drainNext() (entry, bool) {
+	return drainHeap(rs.next)
+}
+
+func drainHeap(h *entryHeap) (entry, bool) {
+	if h.Len() == 0 {
+		return entry{}, false
+	}
+	return heap.Pop(h).(entry), true
+}
@@ -0,0 +1,74 @@
+package extsort
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestReplacementSelectionBoundedMemory feeds already-sorted input, the
+// worst case that used to grow an in-memory run without bound, and checks
+// that the active heap never exceeds its configured capacity while still
+// emitting every record, in order, via Add/drainActive/drainNext.
+func TestReplacementSelectionBoundedMemory(t *testing.T) {
+	const capacity = 4
+	rs := newReplacementSelection(bytesLess, capacity)
+
+	input := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+
+	var out []string
+	for _, k := range input {
+		popped, ok, _ := rs.Add([]byte(k), nil)
+		if ok {
+			out = append(out, string(popped.key))
+		}
+		if rs.active.Len() > capacity {
+			t.Fatalf("active heap grew past capacity %d: %d", capacity, rs.active.Len())
+		}
+	}
+
+	for {
+		e, ok := rs.drainActive()
+		if !ok {
+			break
+		}
+		out = append(out, string(e.key))
+	}
+	for {
+		e, ok := rs.drainNext()
+		if !ok {
+			break
+		}
+		out = append(out, string(e.key))
+	}
+
+	if !reflect.DeepEqual(out, input) {
+		t.Fatalf("got %v, want %v", out, input)
+	}
+}
+
+// TestReplacementSelectionRunsThroughEngine exercises the full Collect path
+// with ReplacementSelectionRuns on unordered input and asserts the merged
+// output comes out sorted.
+func TestReplacementSelectionRunsThroughEngine(t *testing.T) {
+	var out bytes.Buffer
+
+	engine, err := New(&out, bytesLess, 256, WithRunGenerator(ReplacementSelectionRuns))
+	if err != nil {
+		t.Fatalf("cannot create sort engine: %s", err)
+	}
+
+	input := []string{"e", "c", "a", "d", "b", "h", "f", "g"}
+	for _, k := range input {
+		if err := engine.Collect([]byte(k), nil); err != nil {
+			t.Fatalf("cannot collect %q: %s", k, err)
+		}
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("cannot close engine: %s", err)
+	}
+
+	if got, want := out.String(), "abcdefgh"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
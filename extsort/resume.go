@@ -0,0 +1,141 @@
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Resume reopens a session previously written to dir (as recorded by its
+// MANIFEST/CURRENT pair) and returns an io.WriteCloser that lets the caller
+// append more records before merging everything into out. Write accumulates
+// raw bytes; chunkFunc carves them into records the same way it would for a
+// fresh sort. Every record written is added as-is: Resume does not check it
+// against what the session's committed runs already hold, so records that
+// already made it into a spill file come out twice if written again. Close chunks whatever is left, spills it as one more run
+// alongside the session's existing runs, merges everything with less, and
+// writes the result to out.
+//
+// chunkFunc is called repeatedly against one persistent reader over the
+// pending bytes (see the Chunk doc comment for what that requires of
+// chunkFunc), not against r.pending directly, since re-wrapping a
+// bytes.Buffer in a fresh bufio.Reader on every call would silently lose
+// whatever each throwaway reader read ahead past its one chunk.
+func Resume(dir string, chunkFunc Chunk, less Less, out io.Writer) (io.WriteCloser, error) {
+	sess, err := openSession(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resumedSession{
+		session:   sess,
+		chunkFunc: chunkFunc,
+		lessFunc:  less,
+		out:       out,
+		codec:     NewFramingCodec(),
+	}, nil
+}
+
+// resumedSession implements the io.WriteCloser Resume returns.
+type resumedSession struct {
+	session   *session
+	chunkFunc Chunk
+	lessFunc  Less
+	out       io.Writer
+	codec     TmpFileCodec
+
+	pending bytes.Buffer
+}
+
+// Write buffers p; it is chunked and spilled on Close, once chunkFunc has
+// seen everything there is to chunk.
+func (r *resumedSession) Write(p []byte) (int, error) {
+	return r.pending.Write(p)
+}
+
+// Close chunks whatever was written, spills it as a new run, then merges
+// the session's runs (the resumed ones plus this new one) into out.
+func (r *resumedSession) Close() error {
+	defer r.session.remove()
+
+	if r.pending.Len() > 0 {
+		if err := r.spillPending(); err != nil {
+			return err
+		}
+	}
+
+	readers, closeReaders, err := r.openRuns()
+	if err != nil {
+		return err
+	}
+	defer closeReaders()
+
+	mi := newMergeIterator(readers, r.codec, r.lessFunc, reopenedDirFillSize*(len(readers)+1))
+	for mi.Next() {
+		if err := writeRecord(r.out, mi.Key(), mi.Value()); err != nil {
+			return fmt.Errorf("cannot write merged entry to output: %s\n", err)
+		}
+	}
+	if err := mi.Err(); err != nil {
+		return fmt.Errorf("cannot merge temp files: %s\n", err)
+	}
+
+	switch c := r.out.(type) {
+	case io.Closer:
+		return c.Close()
+	default:
+		return nil
+	}
+}
+
+// spillPending chunks r.pending into records with chunkFunc, sorts them, and
+// spills the result as one more run committed to the session's manifest.
+func (r *resumedSession) spillPending() error {
+	buf := NewSortableBuffer(r.lessFunc)(r.pending.Len())
+
+	reader := bufio.NewReaderSize(&r.pending, defaultIoBufferSize)
+	for {
+		item, err := r.chunkFunc(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot chunk resumed input: %s\n", err)
+		}
+		buf.Put(item, nil)
+	}
+	buf.Sort()
+
+	idx := r.session.nextRunIdx()
+	info, err := writeRunFile(r.session, r.codec, idx, buf)
+	if err != nil {
+		return err
+	}
+
+	return r.session.commitRun(info)
+}
+
+// openRuns opens every run recorded in the session's manifest for reading.
+func (r *resumedSession) openRuns() ([]io.Reader, func(), error) {
+	readers := make([]io.Reader, 0, len(r.session.m.Runs))
+	files := make([]io.Closer, 0, len(r.session.m.Runs))
+
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	for _, run := range r.session.m.Runs {
+		file, openErr := openRunFile(r.session, run.Idx)
+		if openErr != nil {
+			closeAll()
+			return nil, nil, openErr
+		}
+		files = append(files, file)
+		readers = append(readers, r.codec.Unwrap(bufio.NewReaderSize(file, defaultIoBufferSize)))
+	}
+
+	return readers, closeAll, nil
+}
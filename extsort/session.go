@@ -0,0 +1,198 @@
+package extsort
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// manifestFilePrefix names successive manifest generations
+	// manifestFilePrefix+"<gen>", so a crash mid-rotation leaves the
+	// previous generation's file intact alongside the half-written one.
+	manifestFilePrefix = "MANIFEST-"
+
+	// currentFileName holds the name of the manifest generation currently
+	// in effect, so resuming a session never has to guess the latest gen.
+	currentFileName = "CURRENT"
+
+	// manifestCodecVersion is recorded against each run so a future codec
+	// change can tell which spill files it wrote.
+	manifestCodecVersion = 1
+)
+
+// runInfo is everything the manifest keeps about one committed spill file:
+// enough to resume a session or report --dry-run statistics without
+// re-reading the file itself.
+type runInfo struct {
+	Idx          int
+	Records      int
+	Bytes        int64
+	MinKey       []byte
+	MaxKey       []byte
+	CodecVersion int
+}
+
+// manifest is the crash-recoverable record of every spill file committed to
+// a session's directory so far.
+type manifest struct {
+	Runs       []runInfo
+	NextRunIdx int
+}
+
+// session manages a sort's on-disk directory: numbered spill files plus a
+// MANIFEST describing the committed ones and a CURRENT file pointing at its
+// latest generation, borrowing LevelDB's file-descriptor + manifest model so
+// a crash never leaves the directory in an ambiguous state. Intermediate
+// merge files (produced by resolveMergeReaders, not Collect) are allocated
+// their own index via nextRunIdx but are never committed to the manifest:
+// they are scratch output, safe to recompute, and resuming a session only
+// ever needs to know about original spills.
+type session struct {
+	dir string
+	gen int
+	m   manifest
+}
+
+// newSession creates a fresh session in a brand-new temp directory.
+func newSession() (*session, error) {
+	dir, err := ioutil.TempDir("", "extsort_tmp_files")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create working directory to store temp files: %s", err)
+	}
+	return &session{dir: dir}, nil
+}
+
+// openSession resumes a session previously written to dir by reading its
+// CURRENT manifest.
+func openSession(dir string) (*session, error) {
+	s := &session{dir: dir}
+
+	name, err := ioutil.ReadFile(filepath.Join(dir, currentFileName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s\n", currentFileName, err)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, string(name)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s\n", name, err)
+	}
+	if err := json.Unmarshal(raw, &s.m); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s\n", name, err)
+	}
+
+	gen, err := strconv.Atoi(strings.TrimPrefix(string(name), manifestFilePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse manifest generation from %s: %s\n", name, err)
+	}
+	s.gen = gen
+
+	return s, nil
+}
+
+// nextRunIdx reserves the next spill file index. The caller decides whether
+// the file it writes there is worth committing to the manifest.
+func (s *session) nextRunIdx() int {
+	idx := s.m.NextRunIdx
+	s.m.NextRunIdx++
+	return idx
+}
+
+// runPath returns the path a spill file with the given index is written to
+// and read back from.
+func (s *session) runPath(idx int) string {
+	return filepath.Join(s.dir, strconv.Itoa(idx))
+}
+
+// commitRun records a newly-written spill file in the manifest and
+// fsync-rotates it in, so the run is crash-safe before the caller relies on
+// it.
+func (s *session) commitRun(info runInfo) error {
+	s.m.Runs = append(s.m.Runs, info)
+	return s.writeManifest()
+}
+
+// writeManifest atomically rotates the CURRENT manifest: it writes the new
+// generation to its own file and fsyncs it, then writes and fsyncs the new
+// CURRENT pointer in a temp file and renames it over CURRENT, so a crash can never observe a CURRENT pointing at a manifest
+// that isn't fully written, nor lose a manifest generation CURRENT already
+// pointed to.
+func (s *session) writeManifest() error {
+	s.gen++
+	name := manifestFilePrefix + strconv.Itoa(s.gen)
+
+	raw, err := json.Marshal(s.m)
+	if err != nil {
+		return fmt.Errorf("cannot encode manifest: %s\n", err)
+	}
+	if err := writeFileSync(filepath.Join(s.dir, name), raw); err != nil {
+		return fmt.Errorf("cannot write %s: %s\n", name, err)
+	}
+
+	currentTmp := filepath.Join(s.dir, currentFileName+".tmp")
+	if err := writeFileSync(currentTmp, []byte(name)); err != nil {
+		return fmt.Errorf("cannot update %s: %s\n", currentFileName, err)
+	}
+	if err := os.Rename(currentTmp, filepath.Join(s.dir, currentFileName)); err != nil {
+		return fmt.Errorf("cannot update %s: %s\n", currentFileName, err)
+	}
+
+	return syncDir(s.dir)
+}
+
+// remove deletes the session's directory and everything in it.
+func (s *session) remove() error {
+	return os.RemoveAll(s.dir)
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Stats summarizes a session's manifest: how many runs memLimit produced
+// and how big they are.
+type Stats struct {
+	Runs    int
+	Records int
+	Bytes   int64
+}
+
+// DryRun reads the manifest previously written to dir and reports run
+// statistics without merging them, so memLimit can be tuned against a
+// partially- or fully-completed session without paying for a merge.
+func DryRun(dir string) (Stats, error) {
+	s, err := openSession(dir)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+	stats.Runs = len(s.m.Runs)
+	for _, r := range s.m.Runs {
+		stats.Records += r.Records
+		stats.Bytes += r.Bytes
+	}
+	return stats, nil
+}
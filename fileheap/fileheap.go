@@ -2,7 +2,7 @@ package fileheap
 
 // FileHeap implements heap.Interface interface.
 // It stores fileheap.Entry entries.
-// The lessFunc function is used in order to compare entries in the heap.
+// The lessFunc function is used in order to compare entries in the heap by key.
 type FileHeap struct {
 	entries  []*Entry
 	lessFunc func([]byte, []byte) bool
@@ -13,18 +13,21 @@ type Entry struct {
 	// Temp file index to search for file descriptor
 	FileIdx int
 
-	// Current line read from file represented as array of bytes
-	Data []byte
+	// Key read from the file, used to order entries in the heap
+	Key []byte
+
+	// Value read from the file alongside Key
+	Val []byte
 }
 
-// NewHeap returns a new file heap. The lessFunc function serves to compare entries in the heap.
+// NewHeap returns a new file heap. The lessFunc function serves to compare entry keys in the heap.
 func NewHeap(lessFunc func([]byte, []byte) bool) *FileHeap {
 	return &FileHeap{lessFunc: lessFunc}
 }
 
 // NewEntry returns a new heap entry.
-func NewEntry(fileIdx int, data []byte) *Entry {
-	return &Entry{FileIdx: fileIdx, Data: data}
+func NewEntry(fileIdx int, key, val []byte) *Entry {
+	return &Entry{FileIdx: fileIdx, Key: key, Val: val}
 }
 
 // Len returns the number of elements in the heap.
@@ -39,7 +42,7 @@ func (fh *FileHeap) Swap(i, j int) {
 
 // Less reports whether the element with index i should placed before the element with index j.
 func (fh *FileHeap) Less(i, j int) bool {
-	return fh.lessFunc(fh.entries[i].Data, fh.entries[j].Data)
+	return fh.lessFunc(fh.entries[i].Key, fh.entries[j].Key)
 }
 
 // Push pushes the element x onto the heap.